@@ -37,16 +37,42 @@ import (
 // and applies diff onto the mounted filesystem.
 func NewFileSystemApplier(cs content.Provider) diff.Applier {
 	return &fsApplier{
-		store: cs,
+		store:    cs,
+		registry: diff.DefaultApplierRegistry(),
 	}
 }
 
 type fsApplier struct {
-	store content.Provider
+	store    content.Provider
+	registry *diff.ApplierRegistry
 }
 
 var emptyDesc = ocispec.Descriptor{}
 
+func init() {
+	diff.RegisterApplier(ocispec.MediaTypeImageLayer, applyTar)
+}
+
+// applyTar is the default ApplierFunc registered for MediaTypeImageLayer:
+// it extracts r as a tar stream onto root using archive.Apply.
+func applyTar(ctx context.Context, root string, r io.Reader, desc ocispec.Descriptor) (int64, digest.Digest, error) {
+	digester := digest.Canonical.Digester()
+	rc := &readCounter{
+		r: io.TeeReader(r, digester.Hash()),
+	}
+
+	if _, err := archive.Apply(ctx, root, rc); err != nil {
+		return 0, "", err
+	}
+
+	// Read any trailing data
+	if _, err := io.Copy(ioutil.Discard, rc); err != nil {
+		return 0, "", err
+	}
+
+	return rc.c, digester.Digest(), nil
+}
+
 // Apply applies the content associated with the provided digests onto the
 // provided mounts. Archive content will be extracted and decompressed if
 // necessary.
@@ -63,49 +89,119 @@ func (s *fsApplier) Apply(ctx context.Context, desc ocispec.Descriptor, mounts [
 		}
 	}()
 
+	ra, err := s.store.ReaderAt(ctx, desc)
+	if err != nil {
+		return emptyDesc, errors.Wrap(err, "failed to get reader from content store")
+	}
+	defer ra.Close()
+
+	return s.applyFromReader(ctx, desc, content.NewReader(ra), mounts, opts...)
+}
+
+// applyFromReader applies desc's content, read from r, onto mounts. It is
+// the part of Apply that does not need the content store directly, so
+// that callers which have already fetched or read-ahead-buffered a
+// layer's content (e.g. the parallel applier) can drive it without
+// re-opening the content store.
+func (s *fsApplier) applyFromReader(ctx context.Context, desc ocispec.Descriptor, r io.Reader, mounts []mount.Mount, opts ...diff.ApplyOpt) (d ocispec.Descriptor, err error) {
+	config, ctx, err := resolveApplyConfig(ctx, desc, opts...)
+	if err != nil {
+		return emptyDesc, err
+	}
+
+	var rawBytesRead int64
+	processor, err := resolveProcessor(ctx, desc, &byteCountingReader{r: r, n: &rawBytesRead}, config)
+	if err != nil {
+		return emptyDesc, err
+	}
+	defer processor.Close()
+
+	return s.applyProcessed(ctx, desc, processor, processor.MediaType(), mounts, config, &rawBytesRead)
+}
+
+// resolveApplyConfig runs opts for desc, returning the resulting
+// ApplyConfig along with ctx extended with any WithApplyContextValues
+// entries it set.
+func resolveApplyConfig(ctx context.Context, desc ocispec.Descriptor, opts ...diff.ApplyOpt) (diff.ApplyConfig, context.Context, error) {
 	var config diff.ApplyConfig
 	for _, o := range opts {
 		if err := o(ctx, desc, &config); err != nil {
-			return emptyDesc, errors.Wrap(err, "failed to apply config opt")
+			return config, ctx, errors.Wrap(err, "failed to apply config opt")
 		}
 	}
 
-	ra, err := s.store.ReaderAt(ctx, desc)
-	if err != nil {
-		return emptyDesc, errors.Wrap(err, "failed to get reader from content store")
+	for k, v := range config.ContextValues {
+		ctx = context.WithValue(ctx, k, v)
 	}
-	defer ra.Close()
 
-	processor := diff.NewProcessorChain(desc.MediaType, content.NewReader(ra))
+	return config, ctx, nil
+}
+
+// resolveProcessor drives the processor chain on r, desc's raw content,
+// until it stops advancing: each call to GetProcessor peels off one layer
+// of decompression or transformation, reporting the new, narrower media
+// type it produced. Once that media type stops changing, the processor
+// has bottomed out at whatever terminal format an ApplierRegistry handler
+// understands. Callers must Close the returned processor.
+func resolveProcessor(ctx context.Context, desc ocispec.Descriptor, r io.Reader, config diff.ApplyConfig) (diff.StreamProcessor, error) {
+	processor := diff.NewProcessorChain(desc.MediaType, &ctxReader{ctx: ctx, r: r})
 	for {
-		if processor, err = diff.GetProcessor(ctx, processor, config.ProcessorPayloads); err != nil {
-			return emptyDesc, errors.Wrapf(err, "failed to get stream processor for %s", desc.MediaType)
+		updated, err := diff.GetProcessor(ctx, processor, config.ProcessorPayloads)
+		if errors.Cause(err) == diff.ErrNoProcessor {
+			// Nothing unwraps this media type any further, so processor
+			// is already at its terminal format.
+			return processor, nil
+		}
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to get stream processor for %s", desc.MediaType)
 		}
-		if processor.MediaType() == ocispec.MediaTypeImageLayer {
-			break
+		done := updated.MediaType() == processor.MediaType()
+		processor = updated
+		if done {
+			return processor, nil
 		}
 	}
-	defer processor.Close()
+}
 
-	digester := digest.Canonical.Digester()
-	rc := &readCounter{
-		r: io.TeeReader(processor, digester.Hash()),
+// applyProcessed applies r, the already fully decompressed/transformed
+// content of desc (r.MediaType() for a resolveProcessor result would
+// equal mediaType), by dispatching to the ApplierRegistry handler
+// registered for mediaType. It is split out from applyFromReader so that
+// callers which resolve the processor chain themselves ahead of time
+// (e.g. the parallel applier's background decompression) can drive the
+// mount/apply/progress steps without redoing that resolution.
+//
+// rawBytesRead is a counter the caller updates from desc's original
+// (compressed) stream, so that progress reporting stays comparable to
+// desc.Size instead of racing ahead of it as decompression expands the
+// data; it may be nil if the caller has not wired one up.
+func (s *fsApplier) applyProcessed(ctx context.Context, desc ocispec.Descriptor, r io.Reader, mediaType string, mounts []mount.Mount, config diff.ApplyConfig, rawBytesRead *int64) (ocispec.Descriptor, error) {
+	applier, ok := s.registry.Get(mediaType)
+	if !ok {
+		return emptyDesc, errors.Errorf("no applier registered for media type %s", mediaType)
 	}
-	if err := mount.WithTempMount(ctx, mounts, func(root string) error {
-		if _, err := archive.Apply(ctx, root, rc); err != nil {
-			return err
-		}
 
-		// Read any trailing data
-		_, err := io.Copy(ioutil.Discard, rc)
+	if rawBytesRead == nil {
+		rawBytesRead = new(int64)
+	}
+	tracked, stopProgress := newProgressTracker(r, rawBytesRead, desc.Size, config.ProgressInterval, config.Progress)
+	defer stopProgress()
+
+	var (
+		size int64
+		dgst digest.Digest
+	)
+	if err := mount.WithTempMount(ctx, mounts, func(root string) error {
+		n, d, err := applier(ctx, root, tracked, desc)
+		size, dgst = n, d
 		return err
 	}); err != nil {
 		return emptyDesc, err
 	}
 	return ocispec.Descriptor{
-		MediaType: ocispec.MediaTypeImageLayer,
-		Size:      rc.c,
-		Digest:    digester.Digest(),
+		MediaType: mediaType,
+		Size:      size,
+		Digest:    dgst,
 	}, nil
 }
 
@@ -0,0 +1,99 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package apply
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/containerd/containerd/diff"
+	"github.com/containerd/containerd/mount"
+	"github.com/containerd/containerd/pkg/testutil"
+	digest "github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+const fakeArtifactMediaType = "application/vnd.containerd.fake-artifact.v1"
+
+// TestApplyRegisteredMediaType verifies that a media type registered on an
+// ApplierRegistry is picked up end-to-end by fsApplier.applyFromReader,
+// including for content whose declared media type is the terminal type
+// itself (i.e. GetProcessor has nothing to unwrap). It uses a private
+// registry rather than diff.DefaultApplierRegistry() so the test doesn't
+// leak a handler into process-wide state.
+func TestApplyRegisteredMediaType(t *testing.T) {
+	testutil.RequiresRoot(t)
+
+	const payload = "hello from a fake artifact layer"
+
+	var applied string
+	registry := diff.NewApplierRegistry()
+	registry.Register(fakeArtifactMediaType, func(ctx context.Context, root string, r io.Reader, desc ocispec.Descriptor) (int64, digest.Digest, error) {
+		b, err := ioutil.ReadAll(r)
+		if err != nil {
+			return 0, "", err
+		}
+		if err := ioutil.WriteFile(filepath.Join(root, "artifact"), b, 0644); err != nil {
+			return 0, "", err
+		}
+		applied = string(b)
+		return int64(len(b)), digest.FromBytes(b), nil
+	})
+
+	root, err := ioutil.TempDir("", "apply-registry-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	mounts := []mount.Mount{
+		{
+			Type:    "bind",
+			Source:  root,
+			Options: []string{"rbind"},
+		},
+	}
+
+	desc := ocispec.Descriptor{
+		MediaType: fakeArtifactMediaType,
+		Digest:    digest.FromString(payload),
+		Size:      int64(len(payload)),
+	}
+
+	fs := &fsApplier{registry: registry}
+
+	if _, err := fs.applyFromReader(context.Background(), desc, strings.NewReader(payload), mounts); err != nil {
+		t.Fatalf("Apply failed: %v", err)
+	}
+
+	if applied != payload {
+		t.Fatalf("expected applier to see %q, got %q", payload, applied)
+	}
+
+	b, err := ioutil.ReadFile(filepath.Join(root, "artifact"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != payload {
+		t.Fatalf("expected artifact file to contain %q, got %q", payload, string(b))
+	}
+}
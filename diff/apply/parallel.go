@@ -0,0 +1,275 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package apply
+
+import (
+	"bufio"
+	"context"
+	"io"
+
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/diff"
+	"github.com/containerd/containerd/mount"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"golang.org/x/sync/semaphore"
+)
+
+const (
+	defaultReadAhead         = 4 << 20 // 4MB
+	defaultDecompressWorkers = 2
+	defaultApplyConcurrency  = 1
+)
+
+// ParallelOpt configures a parallel filesystem applier.
+type ParallelOpt func(*parallelApplier)
+
+// WithReadAhead sets how many bytes of decompressed layer content may be
+// buffered ahead of the tar apply stage consuming it. Defaults to 4MB.
+func WithReadAhead(nBytes int) ParallelOpt {
+	return func(a *parallelApplier) {
+		a.readAhead = nBytes
+	}
+}
+
+// WithDecompressWorkers sets how many layers may be fetched and
+// decompressed concurrently: opening the content store reader, resolving
+// the processor chain (gunzip, etc.), and copying its output into the
+// read-ahead buffer. A layer holds its slot from before it opens the
+// content store through as long as its background goroutine is still
+// producing bytes, including while its read-ahead buffer is being
+// drained by the apply stage, so this also bounds how many layers are
+// "in flight" at once, including their open content.ReaderAts, rather
+// than just the decompression itself. Defaults to 2.
+func WithDecompressWorkers(n int) ParallelOpt {
+	return func(a *parallelApplier) {
+		a.decompressSem = semaphore.NewWeighted(int64(n))
+	}
+}
+
+// WithApplyConcurrency sets how many Apply/ApplyLayers calls may have
+// their filesystem apply stage running concurrently against this
+// applier. Defaults to 1, since layers applied to the same mount must
+// still land in order.
+func WithApplyConcurrency(n int) ParallelOpt {
+	return func(a *parallelApplier) {
+		a.applySem = semaphore.NewWeighted(int64(n))
+	}
+}
+
+// parallelApplier pipelines the fetch and decompress stage of a layer
+// with the filesystem apply stage of the previous layer, so that
+// multi-layer unpacks overlap CPU-bound decompression with I/O-bound
+// filesystem writes instead of serializing them.
+type parallelApplier struct {
+	store content.Provider
+	fs    *fsApplier
+
+	readAhead     int
+	decompressSem *semaphore.Weighted
+	applySem      *semaphore.Weighted
+}
+
+// NewParallelFileSystemApplier returns an applier which, for multi-layer
+// applies made through ApplyLayers, overlaps decompressing layer N+1 with
+// applying layer N to the filesystem. Apply behaves the same as
+// NewFileSystemApplier's for a single descriptor.
+func NewParallelFileSystemApplier(cs content.Provider, opts ...ParallelOpt) diff.Applier {
+	a := &parallelApplier{
+		store:         cs,
+		fs:            &fsApplier{store: cs, registry: diff.DefaultApplierRegistry()},
+		readAhead:     defaultReadAhead,
+		decompressSem: semaphore.NewWeighted(defaultDecompressWorkers),
+		applySem:      semaphore.NewWeighted(defaultApplyConcurrency),
+	}
+	for _, o := range opts {
+		o(a)
+	}
+	return a
+}
+
+// Apply applies desc to mounts. It has no neighboring layer to pipeline
+// against, so it simply bounds itself by the configured apply
+// concurrency and defers to the sequential applier.
+func (a *parallelApplier) Apply(ctx context.Context, desc ocispec.Descriptor, mounts []mount.Mount, opts ...diff.ApplyOpt) (ocispec.Descriptor, error) {
+	if err := a.applySem.Acquire(ctx, 1); err != nil {
+		return ocispec.Descriptor{}, err
+	}
+	defer a.applySem.Release(1)
+
+	return a.fs.Apply(ctx, desc, mounts, opts...)
+}
+
+// layerFetch is a layer whose processor chain has already been resolved
+// and whose terminal (decompressed) stream is being produced ahead of
+// time into a read-ahead buffer.
+type layerFetch struct {
+	ra           content.ReaderAt
+	processor    diff.StreamProcessor
+	r            io.ReadCloser
+	mediaType    string
+	config       diff.ApplyConfig
+	rawBytesRead *int64
+	err          error
+}
+
+func (f *layerFetch) close() {
+	if f.r != nil {
+		f.r.Close()
+	}
+	if f.processor != nil {
+		f.processor.Close()
+	}
+	if f.ra != nil {
+		f.ra.Close()
+	}
+}
+
+// ApplyLayers applies descs to mounts in order. While layer N is being
+// applied to the filesystem, layer N+1's processor chain (fetch +
+// decompress) is resolved and run ahead on a background goroutine,
+// bounded by WithDecompressWorkers and WithReadAhead, so the next layer's
+// terminal stream is ready, or well underway, as soon as the current one
+// finishes applying.
+func (a *parallelApplier) ApplyLayers(ctx context.Context, descs []ocispec.Descriptor, mounts []mount.Mount, opts ...diff.ApplyOpt) ([]ocispec.Descriptor, error) {
+	if err := a.applySem.Acquire(ctx, 1); err != nil {
+		return nil, err
+	}
+	defer a.applySem.Release(1)
+
+	// fetchCtx (and not ctx) governs the prefetch goroutines below, so that
+	// abandoning the remaining layers on an early return also unblocks any
+	// of them still waiting on the decompress semaphore or the content
+	// store.
+	fetchCtx, cancelFetches := context.WithCancel(ctx)
+	defer cancelFetches()
+
+	fetches := make([]chan *layerFetch, len(descs))
+	for i := range descs {
+		fetches[i] = make(chan *layerFetch, 1)
+	}
+
+	// Fetches are started in layer order from a single goroutine, so the
+	// decompress worker slots always go to the earliest layers not yet
+	// applied, never to a later layer ahead of one still being waited on.
+	go func() {
+		for i, desc := range descs {
+			fetches[i] <- a.fetchLayer(fetchCtx, desc, opts...)
+		}
+	}()
+
+	// abandon cancels fetchCtx and drains every not-yet-consumed fetch from
+	// start onward, closing its reader, processor, and content.ReaderAt.
+	// Closing an in-flight fetch's reader unblocks its background
+	// decompression goroutine, which would otherwise sit forever on a full
+	// pipe buffer with nothing left to read it, holding a decompress
+	// worker slot forever.
+	abandon := func(start int) {
+		cancelFetches()
+		for j := start; j < len(descs); j++ {
+			fetch := <-fetches[j]
+			fetch.close()
+		}
+	}
+
+	applied := make([]ocispec.Descriptor, len(descs))
+	for i, desc := range descs {
+		fetch := <-fetches[i]
+		if fetch.err != nil {
+			abandon(i + 1)
+			return nil, fetch.err
+		}
+
+		layerCtx := ctx
+		for k, v := range fetch.config.ContextValues {
+			layerCtx = context.WithValue(layerCtx, k, v)
+		}
+
+		d, err := a.fs.applyProcessed(layerCtx, desc, fetch.r, fetch.mediaType, mounts, fetch.config, fetch.rawBytesRead)
+		fetch.close()
+		if err != nil {
+			abandon(i + 1)
+			return nil, errors.Wrapf(err, "failed to apply layer %s", desc.Digest)
+		}
+		applied[i] = d
+	}
+
+	return applied, nil
+}
+
+// fetchLayer opens desc's content, resolves its processor chain down to a
+// terminal media type, and starts copying its decompressed output into a
+// read-ahead buffer on a background goroutine, returning as soon as that
+// goroutine is started rather than waiting for it to finish. ApplyLayers
+// calls it for each descriptor in order, and WithDecompressWorkers bounds
+// how many layers may actually be fetching (holding an open
+// content.ReaderAt) or decompressing at once; once that many are in
+// flight, the next call blocks below before touching the content store.
+func (a *parallelApplier) fetchLayer(ctx context.Context, desc ocispec.Descriptor, opts ...diff.ApplyOpt) *layerFetch {
+	config, ctx, err := resolveApplyConfig(ctx, desc, opts...)
+	if err != nil {
+		return &layerFetch{err: err}
+	}
+
+	if err := a.decompressSem.Acquire(ctx, 1); err != nil {
+		return &layerFetch{err: err}
+	}
+
+	ra, err := a.store.ReaderAt(ctx, desc)
+	if err != nil {
+		a.decompressSem.Release(1)
+		return &layerFetch{err: errors.Wrap(err, "failed to get reader from content store")}
+	}
+
+	var rawBytesRead int64
+	processor, err := resolveProcessor(ctx, desc, &byteCountingReader{r: content.NewReader(ra), n: &rawBytesRead}, config)
+	if err != nil {
+		a.decompressSem.Release(1)
+		ra.Close()
+		return &layerFetch{err: err}
+	}
+
+	return &layerFetch{
+		ra:           ra,
+		processor:    processor,
+		r:            a.readAheadFrom(processor),
+		mediaType:    processor.MediaType(),
+		config:       config,
+		rawBytesRead: &rawBytesRead,
+	}
+}
+
+// readAheadFrom decouples the caller reading a layer's decompressed
+// content from producing it: up to readAhead bytes are buffered in an
+// in-memory pipe before the producing goroutine, which does the actual
+// decompression work by reading from r, blocks on the consumer. The
+// decompress worker slot acquired by the caller is held until this
+// goroutine finishes, i.e. until the layer has been fully decompressed
+// and consumed (or the reader is closed out from under it).
+func (a *parallelApplier) readAheadFrom(r io.Reader) io.ReadCloser {
+	pr, pw := io.Pipe()
+	go func() {
+		defer a.decompressSem.Release(1)
+		bw := bufio.NewWriterSize(pw, a.readAhead)
+		_, err := io.Copy(bw, r)
+		if err == nil {
+			err = bw.Flush()
+		}
+		pw.CloseWithError(err)
+	}()
+	return pr
+}
@@ -0,0 +1,342 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package apply
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/diff"
+	"github.com/containerd/containerd/mount"
+	"github.com/containerd/containerd/pkg/testutil"
+	digest "github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"golang.org/x/sync/semaphore"
+)
+
+// TestReadAheadFromHoldsSemaphoreUntilDrained verifies that the decompress
+// worker slot acquired before calling readAheadFrom is held for the
+// duration of the real copy, not released as soon as the goroutine starts.
+func TestReadAheadFromHoldsSemaphoreUntilDrained(t *testing.T) {
+	a := &parallelApplier{
+		readAhead:     1024,
+		decompressSem: semaphore.NewWeighted(1),
+	}
+
+	ctx := context.Background()
+	if err := a.decompressSem.Acquire(ctx, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	payload := strings.Repeat("x", 4096)
+	rc := a.readAheadFrom(strings.NewReader(payload))
+
+	// The slot is held by the caller above; a second acquire must not
+	// succeed until the copy goroutine releases it on completion.
+	if a.decompressSem.TryAcquire(1) {
+		t.Fatal("expected decompress semaphore to still be held while the copy is in flight")
+	}
+
+	b, err := ioutil.ReadAll(rc)
+	if err != nil {
+		t.Fatalf("failed to read from read-ahead pipe: %v", err)
+	}
+	if string(b) != payload {
+		t.Fatalf("read-ahead pipe returned %d bytes, want %d", len(b), len(payload))
+	}
+
+	deadline := time.After(time.Second)
+	for {
+		if a.decompressSem.TryAcquire(1) {
+			a.decompressSem.Release(1)
+			break
+		}
+		select {
+		case <-deadline:
+			t.Fatal("expected the copy goroutine to release its semaphore slot once drained")
+		case <-time.After(time.Millisecond):
+		}
+	}
+}
+
+// TestReadAheadFromReleasesOnReaderError verifies that a failing source
+// reader still results in the semaphore slot being released, and that the
+// error is surfaced to the consumer instead of being swallowed.
+func TestReadAheadFromReleasesOnReaderError(t *testing.T) {
+	a := &parallelApplier{
+		readAhead:     1024,
+		decompressSem: semaphore.NewWeighted(1),
+	}
+
+	if err := a.decompressSem.Acquire(context.Background(), 1); err != nil {
+		t.Fatal(err)
+	}
+
+	boom := &erroringReader{err: io.ErrUnexpectedEOF}
+	rc := a.readAheadFrom(boom)
+
+	if _, err := ioutil.ReadAll(rc); err != io.ErrUnexpectedEOF {
+		t.Fatalf("expected io.ErrUnexpectedEOF from the read-ahead pipe, got %v", err)
+	}
+
+	deadline := time.After(time.Second)
+	for !a.decompressSem.TryAcquire(1) {
+		select {
+		case <-deadline:
+			t.Fatal("expected decompress semaphore to be released after the source reader errors")
+		case <-time.After(time.Millisecond):
+		}
+	}
+}
+
+type erroringReader struct {
+	err error
+}
+
+func (r *erroringReader) Read(p []byte) (int, error) {
+	return 0, r.err
+}
+
+// TestLayerFetchCloseNilSafe verifies that an errored layerFetch, whose
+// fields may not all have been populated, can still be closed safely.
+func TestLayerFetchCloseNilSafe(t *testing.T) {
+	(&layerFetch{}).close()
+	(&layerFetch{err: io.ErrClosedPipe}).close()
+}
+
+// fakeLayerMediaType is a terminal media type (no decompression) used to
+// drive ApplyLayers end-to-end without needing a real tar/gzip stream.
+const fakeLayerMediaType = "application/vnd.containerd.fake-layer.v1"
+
+// memoryProvider is a content.Provider backed by an in-memory set of
+// blobs, keyed by digest.
+type memoryProvider struct {
+	blobs map[digest.Digest][]byte
+}
+
+func (p *memoryProvider) ReaderAt(ctx context.Context, desc ocispec.Descriptor) (content.ReaderAt, error) {
+	b, ok := p.blobs[desc.Digest]
+	if !ok {
+		return nil, errors.Errorf("content not found: %s", desc.Digest)
+	}
+	return &memoryReaderAt{b: b}, nil
+}
+
+type memoryReaderAt struct {
+	b []byte
+}
+
+func (r *memoryReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	if off >= int64(len(r.b)) {
+		return 0, io.EOF
+	}
+	n := copy(p, r.b[off:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (r *memoryReaderAt) Close() error { return nil }
+func (r *memoryReaderAt) Size() int64  { return int64(len(r.b)) }
+
+// trackingProvider wraps a content.Provider, counting the content.ReaderAts
+// it has handed out that have not yet been Closed.
+type trackingProvider struct {
+	content.Provider
+	open int32
+}
+
+func (p *trackingProvider) ReaderAt(ctx context.Context, desc ocispec.Descriptor) (content.ReaderAt, error) {
+	ra, err := p.Provider.ReaderAt(ctx, desc)
+	if err != nil {
+		return nil, err
+	}
+	atomic.AddInt32(&p.open, 1)
+	return &trackingReaderAt{ReaderAt: ra, p: p}, nil
+}
+
+type trackingReaderAt struct {
+	content.ReaderAt
+	p      *trackingProvider
+	closed int32
+}
+
+func (r *trackingReaderAt) Close() error {
+	if atomic.CompareAndSwapInt32(&r.closed, 0, 1) {
+		atomic.AddInt32(&r.p.open, -1)
+	}
+	return r.ReaderAt.Close()
+}
+
+// newFakeLayers builds len(contents) descriptors of fakeLayerMediaType, one
+// per entry in contents, backed by a memoryProvider serving them.
+func newFakeLayers(contents ...string) (*memoryProvider, []ocispec.Descriptor) {
+	provider := &memoryProvider{blobs: map[digest.Digest][]byte{}}
+	descs := make([]ocispec.Descriptor, len(contents))
+	for i, c := range contents {
+		b := []byte(c)
+		dgst := digest.FromBytes(b)
+		provider.blobs[dgst] = b
+		descs[i] = ocispec.Descriptor{
+			MediaType: fakeLayerMediaType,
+			Digest:    dgst,
+			Size:      int64(len(b)),
+		}
+	}
+	return provider, descs
+}
+
+// recordingApplier returns an ApplierFunc which appends desc's content to
+// order as it is applied and writes it to a same-named file under root,
+// failing instead if the content equals failOn.
+func recordingApplier(order *[]string, failOn string) diff.ApplierFunc {
+	return func(ctx context.Context, root string, r io.Reader, desc ocispec.Descriptor) (int64, digest.Digest, error) {
+		b, err := ioutil.ReadAll(r)
+		if err != nil {
+			return 0, "", err
+		}
+		name := string(b)
+		if name == failOn {
+			return 0, "", errors.Errorf("simulated apply failure for %s", name)
+		}
+		if err := ioutil.WriteFile(filepath.Join(root, name), b, 0644); err != nil {
+			return 0, "", err
+		}
+		*order = append(*order, name)
+		return int64(len(b)), digest.FromBytes(b), nil
+	}
+}
+
+func bindMountTempDir(t *testing.T) (string, []mount.Mount) {
+	t.Helper()
+	root, err := ioutil.TempDir("", "apply-layers-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(root) })
+	return root, []mount.Mount{{Type: "bind", Source: root, Options: []string{"rbind"}}}
+}
+
+// TestApplyLayersOrderAndDigestsMatchSequential verifies that ApplyLayers
+// applies a multi-layer image in order, landing the same files and
+// digests onto the mount as calling the sequential fsApplier.Apply once
+// per layer would.
+func TestApplyLayersOrderAndDigestsMatchSequential(t *testing.T) {
+	testutil.RequiresRoot(t)
+
+	contents := []string{"layer0", "layer1", "layer2", "layer3"}
+
+	var order []string
+	registry := diff.NewApplierRegistry()
+	registry.Register(fakeLayerMediaType, recordingApplier(&order, ""))
+
+	provider, descs := newFakeLayers(contents...)
+	a := &parallelApplier{
+		store:         provider,
+		fs:            &fsApplier{store: provider, registry: registry},
+		readAhead:     defaultReadAhead,
+		decompressSem: semaphore.NewWeighted(2),
+		applySem:      semaphore.NewWeighted(defaultApplyConcurrency),
+	}
+
+	root, mounts := bindMountTempDir(t)
+
+	applied, err := a.ApplyLayers(context.Background(), descs, mounts)
+	if err != nil {
+		t.Fatalf("ApplyLayers failed: %v", err)
+	}
+
+	if len(order) != len(contents) {
+		t.Fatalf("expected %d layers applied, got %d: %v", len(contents), len(order), order)
+	}
+	for i, c := range contents {
+		if order[i] != c {
+			t.Fatalf("expected layers applied in order %v, got %v", contents, order)
+		}
+
+		b, err := ioutil.ReadFile(filepath.Join(root, c))
+		if err != nil {
+			t.Fatalf("layer %d not applied to mount: %v", i, err)
+		}
+		if string(b) != c {
+			t.Fatalf("layer %d: expected file contents %q, got %q", i, c, string(b))
+		}
+
+		wantDigest := digest.FromBytes([]byte(c))
+		if applied[i].Digest != wantDigest {
+			t.Fatalf("layer %d: expected digest %s (matching a sequential fsApplier.Apply for the same content), got %s", i, wantDigest, applied[i].Digest)
+		}
+	}
+}
+
+// TestApplyLayersErrorDrainsAndReleasesResources verifies that when a
+// layer midway through the series fails to apply, ApplyLayers abandons
+// and closes every not-yet-consumed fetch (so no content.ReaderAt leaks)
+// and releases every decompress worker slot it holds, rather than wedging
+// the semaphore for the rest of the applier's lifetime.
+func TestApplyLayersErrorDrainsAndReleasesResources(t *testing.T) {
+	testutil.RequiresRoot(t)
+
+	contents := []string{"layer0", "layer1", "boom", "layer3"}
+
+	var order []string
+	registry := diff.NewApplierRegistry()
+	registry.Register(fakeLayerMediaType, recordingApplier(&order, "boom"))
+
+	backing, descs := newFakeLayers(contents...)
+	provider := &trackingProvider{Provider: backing}
+	const workers = 2
+	a := &parallelApplier{
+		store:         provider,
+		fs:            &fsApplier{store: provider, registry: registry},
+		readAhead:     defaultReadAhead,
+		decompressSem: semaphore.NewWeighted(workers),
+		applySem:      semaphore.NewWeighted(defaultApplyConcurrency),
+	}
+
+	_, mounts := bindMountTempDir(t)
+
+	_, err := a.ApplyLayers(context.Background(), descs, mounts)
+	if err == nil {
+		t.Fatal("expected ApplyLayers to fail on the simulated apply error")
+	}
+
+	deadline := time.After(time.Second)
+	for atomic.LoadInt32(&provider.open) != 0 {
+		select {
+		case <-deadline:
+			t.Fatalf("expected all content.ReaderAts to be closed after the failed apply, %d still open", atomic.LoadInt32(&provider.open))
+		case <-time.After(time.Millisecond):
+		}
+	}
+
+	for i := 0; i < workers; i++ {
+		if !a.decompressSem.TryAcquire(1) {
+			t.Fatalf("expected decompress semaphore slot %d to be reacquirable after the failed apply", i)
+		}
+	}
+}
@@ -0,0 +1,140 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package apply
+
+import (
+	"archive/tar"
+	"context"
+	"io"
+	"io/ioutil"
+	"sync/atomic"
+	"time"
+
+	"github.com/containerd/containerd/diff"
+)
+
+// ctxReader aborts Read with ctx.Err() once ctx is done, letting a stuck
+// pull be cancelled between (and within) tar entries instead of only
+// between layers.
+type ctxReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (r *ctxReader) Read(p []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return r.r.Read(p)
+}
+
+// progressTracker wraps r so that fn is called on interval with the
+// number of bytes read and tar entries applied so far, until stop is
+// called. It works by teeing the stream into its own tar reader running
+// in a goroutine, independent of whatever consumes the returned reader.
+type progressTracker struct {
+	r io.Reader
+
+	bytesRead *int64
+	entries   int64
+
+	start time.Time
+	pw    *io.PipeWriter
+	done  chan struct{}
+}
+
+// newProgressTracker starts tracking progress of r, the terminal
+// (decompressed) stream being applied, reporting entries counted from r
+// alongside the bytes accumulated in bytesRead. bytesRead is read
+// atomically and is expected to be updated by the caller from the same
+// (compressed) stream desc.Size describes, so that the reported
+// BytesRead stays comparable to BytesTotal instead of racing ahead of it
+// as decompression expands the data. Call stop on the returned tracker
+// once the apply is finished (successfully or not) to deliver a final
+// progress report and release resources.
+func newProgressTracker(r io.Reader, bytesRead *int64, total int64, interval time.Duration, fn func(diff.ApplyProgress)) (io.Reader, func()) {
+	if fn == nil {
+		return r, func() {}
+	}
+
+	t := &progressTracker{start: time.Now(), done: make(chan struct{}), bytesRead: bytesRead}
+
+	pr, pw := io.Pipe()
+	t.pw = pw
+	t.r = io.TeeReader(r, pw)
+
+	go t.countEntries(pr)
+
+	stop := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				fn(t.progress(total))
+			case <-stop:
+				return
+			}
+		}
+	}()
+
+	return t.r, func() {
+		close(stop)
+		pw.Close()
+		<-t.done
+		fn(t.progress(total))
+	}
+}
+
+func (t *progressTracker) progress(total int64) diff.ApplyProgress {
+	return diff.ApplyProgress{
+		BytesRead:      atomic.LoadInt64(t.bytesRead),
+		BytesTotal:     total,
+		EntriesApplied: int(atomic.LoadInt64(&t.entries)),
+		Elapsed:        time.Since(t.start),
+	}
+}
+
+// countEntries reads tar headers off the teed copy of the stream,
+// counting one entry per header, until the stream ends or is closed.
+func (t *progressTracker) countEntries(pr *io.PipeReader) {
+	defer close(t.done)
+	defer io.Copy(ioutil.Discard, pr) // drain so the writer side never blocks on us
+
+	tr := tar.NewReader(pr)
+	for {
+		if _, err := tr.Next(); err != nil {
+			return
+		}
+		atomic.AddInt64(&t.entries, 1)
+		if _, err := io.Copy(ioutil.Discard, tr); err != nil {
+			return
+		}
+	}
+}
+
+type byteCountingReader struct {
+	r io.Reader
+	n *int64
+}
+
+func (r *byteCountingReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	atomic.AddInt64(r.n, int64(n))
+	return n, err
+}
@@ -0,0 +1,98 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package apply
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/containerd/containerd/diff"
+)
+
+func TestCtxReaderStopsOnCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	r := &ctxReader{ctx: ctx, r: strings.NewReader("hello world")}
+
+	buf := make([]byte, 4)
+	if _, err := r.Read(buf); err != nil {
+		t.Fatalf("expected a read before cancellation to succeed, got %v", err)
+	}
+
+	cancel()
+
+	if _, err := r.Read(buf); err != ctx.Err() {
+		t.Fatalf("expected Read to return ctx.Err() after cancellation, got %v", err)
+	}
+}
+
+func TestProgressTrackerCountsBytesAndEntries(t *testing.T) {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, name := range []string{"a", "b"} {
+		contents := []byte(name + "-contents")
+		if err := tw.WriteHeader(&tar.Header{Name: name, Size: int64(len(contents))}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write(contents); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	reports := make(chan diff.ApplyProgress, 16)
+	var bytesRead int64
+	counted := &byteCountingReader{r: bytes.NewReader(buf.Bytes()), n: &bytesRead}
+	tracked, stop := newProgressTracker(counted, &bytesRead, int64(buf.Len()), 10*time.Millisecond, func(p diff.ApplyProgress) {
+		reports <- p
+	})
+
+	if _, err := io.Copy(ioutil.Discard, tracked); err != nil {
+		t.Fatalf("failed to read tracked reader: %v", err)
+	}
+	stop()
+	close(reports)
+
+	var last diff.ApplyProgress
+	for p := range reports {
+		last = p
+	}
+
+	if last.BytesRead != int64(buf.Len()) {
+		t.Fatalf("expected BytesRead to equal the full stream length %d, got %d", buf.Len(), last.BytesRead)
+	}
+	if last.EntriesApplied != 2 {
+		t.Fatalf("expected 2 entries counted, got %d", last.EntriesApplied)
+	}
+}
+
+func TestNewProgressTrackerNoopWithoutCallback(t *testing.T) {
+	r := strings.NewReader("payload")
+	var bytesRead int64
+	tracked, stop := newProgressTracker(r, &bytesRead, int64(r.Len()), time.Second, nil)
+	if tracked != r {
+		t.Fatal("expected newProgressTracker to return r unchanged when fn is nil")
+	}
+	stop()
+}
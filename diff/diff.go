@@ -0,0 +1,196 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package diff
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/containerd/containerd/mount"
+	digest "github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+)
+
+// Applier applies content onto a set of mounts
+type Applier interface {
+	Apply(ctx context.Context, desc ocispec.Descriptor, mounts []mount.Mount, opts ...ApplyOpt) (ocispec.Descriptor, error)
+}
+
+// Comparer creates a diff between the provided mounts
+type Comparer interface {
+	Compare(ctx context.Context, lower, upper []mount.Mount, opts ...Opt) (ocispec.Descriptor, error)
+}
+
+// Config is used to hold parameters needed for a diff operation
+type Config struct {
+	// MediaType is the type of diff to generate
+	MediaType string
+
+	// Reference is the content upload reference to use
+	Reference string
+
+	// Labels are the labels to apply to the generated content
+	Labels map[string]string
+}
+
+// Opt is used to configure a diff operation
+type Opt func(*Config) error
+
+// ApplyConfig is used to hold parameters needed for an apply operation
+type ApplyConfig struct {
+	// ProcessorPayloads specifies the payload sent to any stream processors configured for the media type of the payload.
+	ProcessorPayloads map[string][]byte
+
+	// Progress, if set, is called periodically while Apply is unpacking a
+	// layer. See WithProgress.
+	Progress func(ApplyProgress)
+
+	// ProgressInterval is how often Progress is called. See WithProgress.
+	ProgressInterval time.Duration
+
+	// ContextValues are key/value pairs attached to the context passed
+	// down through the apply pipeline. See WithApplyContextValues.
+	ContextValues map[interface{}]interface{}
+}
+
+// ApplyOpt is used to configure an Apply operation
+type ApplyOpt func(ctx context.Context, desc ocispec.Descriptor, config *ApplyConfig) error
+
+// ApplyProgress reports how far an in-flight Apply has gotten unpacking a
+// single layer.
+type ApplyProgress struct {
+	// BytesRead is the number of bytes of desc's original (compressed, as
+	// stored) content read so far, comparable to BytesTotal.
+	BytesRead int64
+
+	// BytesTotal is the descriptor's reported size, i.e. the size of the
+	// compressed blob as stored in the content store.
+	BytesTotal int64
+
+	// EntriesApplied is the number of tar entries applied so far.
+	EntriesApplied int
+
+	// Elapsed is the time since Apply started unpacking this layer.
+	Elapsed time.Duration
+}
+
+// defaultProgressInterval is how often WithProgress reports progress when
+// no ProgressInterval is given.
+const defaultProgressInterval = 500 * time.Millisecond
+
+// WithProgress registers fn to be called periodically while Apply unpacks
+// desc, reporting bytes read and tar entries applied so far, and once
+// more when the apply finishes or fails. Use WithProgressInterval to
+// change how often fn is called; it defaults to 500ms.
+func WithProgress(fn func(ApplyProgress)) ApplyOpt {
+	return func(ctx context.Context, desc ocispec.Descriptor, config *ApplyConfig) error {
+		config.Progress = fn
+		if config.ProgressInterval == 0 {
+			config.ProgressInterval = defaultProgressInterval
+		}
+		return nil
+	}
+}
+
+// WithProgressInterval sets how often the callback passed to WithProgress
+// is invoked. Defaults to 500ms.
+func WithProgressInterval(d time.Duration) ApplyOpt {
+	return func(ctx context.Context, desc ocispec.Descriptor, config *ApplyConfig) error {
+		config.ProgressInterval = d
+		return nil
+	}
+}
+
+// WithApplyContextValues attaches the given key/value pairs, taken as
+// alternating key, value, key, value..., to the context that is threaded
+// through the remainder of the apply pipeline, so that applier
+// implementations and any stream processors they invoke can recover
+// caller-supplied values via ctx.Value without a dedicated ApplyOpt for
+// each one.
+func WithApplyContextValues(keyvals ...interface{}) ApplyOpt {
+	return func(ctx context.Context, desc ocispec.Descriptor, config *ApplyConfig) error {
+		if len(keyvals)%2 != 0 {
+			return errors.New("WithApplyContextValues: keyvals must be key/value pairs")
+		}
+		if config.ContextValues == nil {
+			config.ContextValues = make(map[interface{}]interface{}, len(keyvals)/2)
+		}
+		for i := 0; i < len(keyvals); i += 2 {
+			config.ContextValues[keyvals[i]] = keyvals[i+1]
+		}
+		return nil
+	}
+}
+
+// ApplierFunc unpacks the terminal (non-decompressible, non-transformable)
+// stream r of desc onto the filesystem rooted at root, returning the
+// number of bytes consumed from r and the digest of the stream.
+type ApplierFunc func(ctx context.Context, root string, r io.Reader, desc ocispec.Descriptor) (int64, digest.Digest, error)
+
+// ApplierRegistry maps a terminal media type to the ApplierFunc
+// responsible for unpacking it. A terminal media type is whatever
+// GetProcessor settles on once it has nothing left to decompress or
+// transform, e.g. MediaTypeImageLayer for a plain tar stream, but may
+// just as well be a stargz TOC, a squashfs image, or an arbitrary OCI
+// artifact media type. Out-of-tree code can register a handler for its
+// own media type without forking Applier implementations.
+type ApplierRegistry struct {
+	mu       sync.RWMutex
+	appliers map[string]ApplierFunc
+}
+
+// NewApplierRegistry returns an empty ApplierRegistry.
+func NewApplierRegistry() *ApplierRegistry {
+	return &ApplierRegistry{
+		appliers: make(map[string]ApplierFunc),
+	}
+}
+
+// Register associates mediaType with fn, replacing any handler
+// previously registered for that media type.
+func (r *ApplierRegistry) Register(mediaType string, fn ApplierFunc) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.appliers[mediaType] = fn
+}
+
+// Get returns the handler registered for mediaType, if any.
+func (r *ApplierRegistry) Get(mediaType string) (ApplierFunc, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	fn, ok := r.appliers[mediaType]
+	return fn, ok
+}
+
+// defaultApplierRegistry is the package-level registry used by
+// RegisterApplier and by Appliers that do not hold one of their own.
+var defaultApplierRegistry = NewApplierRegistry()
+
+// RegisterApplier registers fn as the handler for mediaType in the
+// default, package-level ApplierRegistry.
+func RegisterApplier(mediaType string, fn ApplierFunc) {
+	defaultApplierRegistry.Register(mediaType, fn)
+}
+
+// DefaultApplierRegistry returns the package-level ApplierRegistry
+// populated by RegisterApplier.
+func DefaultApplierRegistry() *ApplierRegistry {
+	return defaultApplierRegistry
+}
@@ -0,0 +1,209 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package auth
+
+import (
+	"context"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// defaultExpireSkew is the amount of time before a cached token's reported
+// expiry at which it is considered stale, to account for clock drift and
+// the time spent actually using the token once fetched.
+const defaultExpireSkew = 10 * time.Second
+
+// defaultTokenTTL is the lifetime assumed for a token whose response omits
+// expires_in, per the distribution spec: "If expires_in is not specified,
+// a default value of 60 seconds SHALL be assumed." Servers that only
+// implement the GET flow (anonymous pulls, OAuth-less registries) commonly
+// omit it; without a default they would never be cached at all.
+const defaultTokenTTL = 60 * time.Second
+
+// cacheKey identifies a cached token by the host it was issued for, the
+// service named in the challenge, and the sorted set of scopes it was
+// requested with.
+type cacheKey struct {
+	host    string
+	service string
+	scopes  string
+}
+
+func newCacheKey(host string, to TokenOptions) cacheKey {
+	scopes := append([]string(nil), to.Scopes...)
+	sort.Strings(scopes)
+	return cacheKey{
+		host:    host,
+		service: to.Service,
+		scopes:  strings.Join(scopes, " "),
+	}
+}
+
+type cachedToken struct {
+	resp      *OAuthTokenResponse
+	expiresAt time.Time
+}
+
+func (c *cachedToken) expired(now time.Time) bool {
+	return !now.Before(c.expiresAt)
+}
+
+// CachingAuthorizer caches tokens fetched through FetchToken and
+// FetchTokenWithOAuth, keyed by host, service, and scope, and transparently
+// refreshes them as they approach expiry. When the authorization server
+// returns a refresh token alongside the access token, the cached entry is
+// refreshed using the OAuth2 `refresh_token` grant instead of re-running
+// the original credential based challenge.
+//
+// The OAuth2 POST /token flow is only attempted when there is a refresh
+// token or real credentials to exchange for one; anonymous requests, and
+// any realm that doesn't implement that endpoint (GCR, quay.io, ECR, ACR,
+// and plain docker/distribution deployments without the optional OAuth2
+// provider all only speak the GET flow), fall back to the plain GET-based
+// FetchTokenResponse, exactly as FetchToken itself would.
+type CachingAuthorizer struct {
+	client     *http.Client
+	clientID   string
+	expireSkew time.Duration
+
+	mu    sync.Mutex
+	cache map[cacheKey]*cachedToken
+}
+
+// CachingAuthorizerOpt configures a CachingAuthorizer.
+type CachingAuthorizerOpt func(*CachingAuthorizer)
+
+// WithExpireSkew sets the duration before a token's reported expiry at
+// which it is treated as stale and eagerly refreshed. Defaults to 10s.
+func WithExpireSkew(skew time.Duration) CachingAuthorizerOpt {
+	return func(a *CachingAuthorizer) {
+		a.expireSkew = skew
+	}
+}
+
+// WithAuthClientID sets the OAuth2 client_id used when refreshing tokens
+// via FetchTokenWithOAuthResponse. Defaults to "containerd-client".
+func WithAuthClientID(id string) CachingAuthorizerOpt {
+	return func(a *CachingAuthorizer) {
+		a.clientID = id
+	}
+}
+
+// NewCachingAuthorizer returns a CachingAuthorizer which uses client to
+// perform token requests.
+func NewCachingAuthorizer(client *http.Client, opts ...CachingAuthorizerOpt) *CachingAuthorizer {
+	a := &CachingAuthorizer{
+		client:     client,
+		clientID:   "containerd-client",
+		expireSkew: defaultExpireSkew,
+		cache:      map[cacheKey]*cachedToken{},
+	}
+	for _, opt := range opts {
+		opt(a)
+	}
+	return a
+}
+
+// FetchToken returns a token for the given host and token options, reusing
+// a cached token when one is available and not yet close to expiring. The
+// first fetch for a given (host, service, scopes) uses the credentials in
+// to; later calls reuse the cached token or, once it approaches expiry,
+// refresh it silently using the refresh token the server returned, falling
+// back to to's credentials if no refresh token is available.
+func (a *CachingAuthorizer) FetchToken(ctx context.Context, host string, headers http.Header, to TokenOptions) (string, error) {
+	key := newCacheKey(host, to)
+
+	a.mu.Lock()
+	entry := a.cache[key]
+	a.mu.Unlock()
+
+	now := time.Now()
+	if entry != nil && !entry.expired(now.Add(a.expireSkew)) {
+		return entry.resp.AccessToken, nil
+	}
+
+	refresh := to
+	usingCachedRefreshToken := entry != nil && entry.resp.RefreshToken != ""
+	if usingCachedRefreshToken {
+		refresh.Username = ""
+		refresh.Secret = entry.resp.RefreshToken
+	}
+
+	resp, err := a.fetch(ctx, headers, refresh, to, usingCachedRefreshToken)
+	if err != nil {
+		return "", err
+	}
+
+	ttl := defaultTokenTTL
+	if resp.ExpiresIn > 0 {
+		ttl = time.Duration(resp.ExpiresIn) * time.Second
+	}
+	cached := &cachedToken{resp: resp, expiresAt: now.Add(ttl)}
+
+	a.mu.Lock()
+	a.cache[key] = cached
+	a.mu.Unlock()
+
+	return resp.AccessToken, nil
+}
+
+// fetch requests a token using refresh, which carries either to's original
+// credentials or a cached refresh token; usingCachedRefreshToken records
+// which. The OAuth2 POST flow is only attempted when refresh actually has
+// something to exchange (a refresh token or credentials); a fully
+// anonymous refresh, or a realm that answers the OAuth2 endpoint with
+// 404/405, falls back to the plain GET-based flow using to's original
+// credentials, since a refresh token has no meaning there.
+//
+// When the POST flow is rejected for any reason while using a cached
+// refresh token (e.g. the server revoked it, returning 401/403 rather
+// than 404/405), that refresh token is not retried: this recurses once
+// with to's original credentials, so a revoked refresh token doesn't
+// permanently wedge an otherwise-valid login behind a stale cache entry.
+func (a *CachingAuthorizer) fetch(ctx context.Context, headers http.Header, refresh, to TokenOptions, usingCachedRefreshToken bool) (*OAuthTokenResponse, error) {
+	if refresh.Username == "" && refresh.Secret == "" {
+		return FetchTokenResponse(ctx, a.client, headers, to)
+	}
+
+	resp, err := FetchTokenWithOAuthResponse(ctx, a.client, headers, a.clientID, refresh)
+	if err == nil {
+		return resp, nil
+	}
+	if usingCachedRefreshToken {
+		return a.fetch(ctx, headers, to, to, false)
+	}
+	if !isOAuthNotImplemented(err) {
+		return nil, err
+	}
+
+	return FetchTokenResponse(ctx, a.client, headers, to)
+}
+
+// isOAuthNotImplemented reports whether err is an ErrUnexpectedStatus
+// indicating the realm doesn't implement the OAuth2 POST /token endpoint.
+func isOAuthNotImplemented(err error) bool {
+	unexpected, ok := errors.Cause(err).(ErrUnexpectedStatus)
+	if !ok {
+		return false
+	}
+	return unexpected.StatusCode == http.StatusNotFound || unexpected.StatusCode == http.StatusMethodNotAllowed
+}
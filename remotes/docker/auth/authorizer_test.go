@@ -0,0 +1,238 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package auth
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// TestCachingAuthorizerGetFallback verifies that a realm which only
+// implements the GET flow (no OAuth2 POST /token endpoint) is still usable:
+// the first attempt at the POST flow gets a 404, and FetchToken falls back
+// to the GET flow instead of failing the request.
+func TestCachingAuthorizerGetFallback(t *testing.T) {
+	var requests int32
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		if r.Method == http.MethodPost {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		json.NewEncoder(w).Encode(getTokenResponse{Token: "get-flow-token"})
+	}))
+	defer srv.Close()
+
+	a := NewCachingAuthorizer(srv.Client())
+	to := TokenOptions{Realm: srv.URL, Username: "user", Secret: "pass"}
+
+	token, err := a.FetchToken(context.Background(), "registry.example.com", nil, to)
+	if err != nil {
+		t.Fatalf("FetchToken failed: %v", err)
+	}
+	if token != "get-flow-token" {
+		t.Fatalf("expected get-flow-token, got %q", token)
+	}
+	if got := atomic.LoadInt32(&requests); got != 2 {
+		t.Fatalf("expected POST attempt then GET fallback (2 requests), got %d", got)
+	}
+}
+
+// TestCachingAuthorizerAnonymousSkipsPost verifies that a request with no
+// credentials and no cached refresh token goes straight to the GET flow,
+// without first trying (and failing) the POST flow.
+func TestCachingAuthorizerAnonymousSkipsPost(t *testing.T) {
+	var sawPost bool
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPost {
+			sawPost = true
+		}
+		json.NewEncoder(w).Encode(getTokenResponse{Token: "anon-token"})
+	}))
+	defer srv.Close()
+
+	a := NewCachingAuthorizer(srv.Client())
+	to := TokenOptions{Realm: srv.URL}
+
+	token, err := a.FetchToken(context.Background(), "registry.example.com", nil, to)
+	if err != nil {
+		t.Fatalf("FetchToken failed: %v", err)
+	}
+	if token != "anon-token" {
+		t.Fatalf("expected anon-token, got %q", token)
+	}
+	if sawPost {
+		t.Fatal("expected anonymous request to skip the POST flow entirely")
+	}
+}
+
+// TestCachingAuthorizerCachesWithoutExpiresIn verifies that a token response
+// omitting expires_in is still cached (using the default TTL), rather than
+// being re-fetched on every call.
+func TestCachingAuthorizerCachesWithoutExpiresIn(t *testing.T) {
+	var requests int32
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		json.NewEncoder(w).Encode(getTokenResponse{Token: "no-ttl-token"})
+	}))
+	defer srv.Close()
+
+	a := NewCachingAuthorizer(srv.Client())
+	to := TokenOptions{Realm: srv.URL}
+
+	for i := 0; i < 3; i++ {
+		token, err := a.FetchToken(context.Background(), "registry.example.com", nil, to)
+		if err != nil {
+			t.Fatalf("FetchToken failed: %v", err)
+		}
+		if token != "no-ttl-token" {
+			t.Fatalf("expected no-ttl-token, got %q", token)
+		}
+	}
+
+	if got := atomic.LoadInt32(&requests); got != 1 {
+		t.Fatalf("expected a single request with the rest served from cache, got %d", got)
+	}
+}
+
+// TestCachingAuthorizerRefreshTokenReissue verifies the headline case of a
+// caching, auto-refreshing authorizer: once a password grant returns a
+// refresh token, a later fetch (forced by a short TTL) reissues via the
+// refresh_token grant instead of presenting the original password again.
+func TestCachingAuthorizerRefreshTokenReissue(t *testing.T) {
+	var requests int32
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt32(&requests, 1)
+		if err := r.ParseForm(); err != nil {
+			t.Fatal(err)
+		}
+
+		if n == 1 {
+			if r.FormValue("grant_type") != "password" {
+				t.Fatalf("expected first request to be a password grant, got %q", r.FormValue("grant_type"))
+			}
+			json.NewEncoder(w).Encode(postTokenResponse{AccessToken: "first-token", RefreshToken: "refresh-me", ExpiresIn: 1})
+			return
+		}
+
+		if r.FormValue("grant_type") != "refresh_token" || r.FormValue("refresh_token") != "refresh-me" {
+			t.Fatalf("expected a refresh_token grant with the cached refresh token, got grant_type=%q refresh_token=%q", r.FormValue("grant_type"), r.FormValue("refresh_token"))
+		}
+		json.NewEncoder(w).Encode(postTokenResponse{AccessToken: "reissued-token", RefreshToken: "refresh-me", ExpiresIn: 60})
+	}))
+	defer srv.Close()
+
+	a := NewCachingAuthorizer(srv.Client())
+	to := TokenOptions{Realm: srv.URL, Username: "user", Secret: "pass"}
+
+	token, err := a.FetchToken(context.Background(), "registry.example.com", nil, to)
+	if err != nil {
+		t.Fatalf("FetchToken failed: %v", err)
+	}
+	if token != "first-token" {
+		t.Fatalf("expected first-token, got %q", token)
+	}
+
+	time.Sleep(1100 * time.Millisecond)
+
+	token, err = a.FetchToken(context.Background(), "registry.example.com", nil, to)
+	if err != nil {
+		t.Fatalf("FetchToken failed: %v", err)
+	}
+	if token != "reissued-token" {
+		t.Fatalf("expected reissued-token, got %q", token)
+	}
+	if got := atomic.LoadInt32(&requests); got != 2 {
+		t.Fatalf("expected a password grant then a refresh_token grant (2 requests), got %d", got)
+	}
+}
+
+// TestCachingAuthorizerRefreshTokenRejectedFallsBack verifies that when a
+// cached refresh token is rejected by the server (e.g. revoked, returning
+// 401), FetchToken falls back to to's original credentials instead of
+// failing forever on the same stale cache entry.
+func TestCachingAuthorizerRefreshTokenRejectedFallsBack(t *testing.T) {
+	var requests int32
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt32(&requests, 1)
+		if err := r.ParseForm(); err != nil {
+			t.Fatal(err)
+		}
+
+		switch {
+		case n == 1:
+			json.NewEncoder(w).Encode(postTokenResponse{AccessToken: "first-token", RefreshToken: "revoked-later", ExpiresIn: 1})
+		case r.FormValue("grant_type") == "refresh_token":
+			w.WriteHeader(http.StatusUnauthorized)
+		case r.FormValue("grant_type") == "password" && r.FormValue("username") == "user":
+			json.NewEncoder(w).Encode(postTokenResponse{AccessToken: "password-token", ExpiresIn: 60})
+		default:
+			t.Fatalf("unexpected request: grant_type=%q username=%q", r.FormValue("grant_type"), r.FormValue("username"))
+		}
+	}))
+	defer srv.Close()
+
+	a := NewCachingAuthorizer(srv.Client())
+	to := TokenOptions{Realm: srv.URL, Username: "user", Secret: "pass"}
+
+	token, err := a.FetchToken(context.Background(), "registry.example.com", nil, to)
+	if err != nil {
+		t.Fatalf("FetchToken failed: %v", err)
+	}
+	if token != "first-token" {
+		t.Fatalf("expected first-token, got %q", token)
+	}
+
+	time.Sleep(1100 * time.Millisecond)
+
+	token, err = a.FetchToken(context.Background(), "registry.example.com", nil, to)
+	if err != nil {
+		t.Fatalf("expected a rejected refresh token to fall back to the password grant, got error: %v", err)
+	}
+	if token != "password-token" {
+		t.Fatalf("expected password-token, got %q", token)
+	}
+	if got := atomic.LoadInt32(&requests); got != 3 {
+		t.Fatalf("expected password grant, rejected refresh grant, then password grant fallback (3 requests), got %d", got)
+	}
+}
+
+// TestCachedTokenExpired verifies the expired helper directly, since the
+// default TTL behavior above only exercises it indirectly.
+func TestCachedTokenExpired(t *testing.T) {
+	now := time.Now()
+
+	expired := &cachedToken{expiresAt: now.Add(-time.Second)}
+	if !expired.expired(now) {
+		t.Fatal("expected token with a past expiresAt to be expired")
+	}
+
+	fresh := &cachedToken{expiresAt: now.Add(time.Minute)}
+	if fresh.expired(now) {
+		t.Fatal("expected token with a future expiresAt to not be expired")
+	}
+}
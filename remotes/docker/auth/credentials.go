@@ -0,0 +1,229 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package auth
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// CredentialProvider resolves the username/secret to use when
+// authenticating against a given registry host. When the returned secret
+// is an identity token rather than a password, isRefreshToken is true and
+// callers should drive FetchTokenWithOAuth (or FetchTokenWithOAuthResponse)
+// with `grant_type=refresh_token` instead of a password grant.
+type CredentialProvider interface {
+	Get(ctx context.Context, host string) (user, secret string, isRefreshToken bool, err error)
+}
+
+// identityToken is the sentinel username docker-credential-helpers and
+// ~/.docker/config.json use to mark a stored secret as an identity
+// (refresh) token rather than a password.
+const identityToken = "<token>"
+
+// credentialsNotFoundMessage is the sentinel error message the
+// docker-credential-helpers protocol defines for a cache miss: the
+// binary exits non-zero but it does not indicate a real failure, so
+// callers treat it as "no credentials for this host" rather than an
+// error. See docker/docker-credential-helpers/credentials.errors.go.
+const credentialsNotFoundMessage = "credentials not found in native keychain"
+
+// nativeStoreProvider is a CredentialProvider backed by a
+// docker-credential-<helper> binary on PATH.
+type nativeStoreProvider struct {
+	helper string
+}
+
+// NewNativeStoreProvider returns a CredentialProvider which resolves
+// credentials by shelling out to the docker-credential-<helper> binary,
+// using the get/store/erase JSON-over-stdio protocol documented by
+// docker/docker-credential-helpers.
+func NewNativeStoreProvider(helper string) CredentialProvider {
+	return &nativeStoreProvider{helper: helper}
+}
+
+type credentialHelperOutput struct {
+	ServerURL string `json:"ServerURL"`
+	Username  string `json:"Username"`
+	Secret    string `json:"Secret"`
+}
+
+func (p *nativeStoreProvider) Get(ctx context.Context, host string) (string, string, bool, error) {
+	cmd := exec.CommandContext(ctx, "docker-credential-"+p.helper, "get")
+	cmd.Stdin = strings.NewReader(host)
+
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	if err := cmd.Run(); err != nil {
+		if strings.Contains(stdout.String(), credentialsNotFoundMessage) {
+			return "", "", false, nil
+		}
+		return "", "", false, errors.Wrapf(err, "docker-credential-%s get: %s", p.helper, strings.TrimSpace(stderr.String()))
+	}
+
+	var out credentialHelperOutput
+	if err := json.Unmarshal(stdout.Bytes(), &out); err != nil {
+		return "", "", false, errors.Wrapf(err, "docker-credential-%s get: invalid response", p.helper)
+	}
+
+	if out.Username == identityToken {
+		return "", out.Secret, true, nil
+	}
+
+	return out.Username, out.Secret, false, nil
+}
+
+// dockerConfigFile is the subset of ~/.docker/config.json this package
+// understands.
+type dockerConfigFile struct {
+	Auths       map[string]dockerConfigAuth `json:"auths"`
+	CredHelpers map[string]string           `json:"credHelpers"`
+	CredsStore  string                      `json:"credsStore"`
+}
+
+type dockerConfigAuth struct {
+	Auth string `json:"auth"`
+}
+
+// dockerConfigProvider is a CredentialProvider backed by a Docker CLI
+// style config.json, resolving per-host credential helpers before
+// falling back to the base64 encoded `auths` entry for the host.
+type dockerConfigProvider struct {
+	path string
+}
+
+// NewDockerConfigProvider returns a CredentialProvider which reads
+// credentials from a Docker CLI style config.json at path, resolving
+// `credHelpers` and `credsStore` per host before falling back to the
+// base64 encoded `auths` entry for the host. If path is empty, the
+// default Docker CLI config location is used, honoring $DOCKER_CONFIG.
+func NewDockerConfigProvider(path string) CredentialProvider {
+	if path == "" {
+		path = defaultDockerConfigPath()
+	}
+	return &dockerConfigProvider{path: path}
+}
+
+// dockerHubConfigKey is the canonical key the Docker CLI stores and looks
+// up Docker Hub credentials under, regardless of which Hub hostname a
+// caller actually resolved and authenticates against.
+const dockerHubConfigKey = "https://index.docker.io/v1/"
+
+// dockerHubAliases are the Hub hostnames that resolve to dockerHubConfigKey.
+var dockerHubAliases = map[string]bool{
+	"docker.io":            true,
+	"index.docker.io":      true,
+	"registry-1.docker.io": true,
+}
+
+// resolveConfigHost maps a Docker Hub hostname alias to the canonical key
+// config.json stores its credentials under, the way the Docker CLI does;
+// any other host is used as-is.
+func resolveConfigHost(host string) string {
+	if dockerHubAliases[host] {
+		return dockerHubConfigKey
+	}
+	return host
+}
+
+func (p *dockerConfigProvider) Get(ctx context.Context, host string) (string, string, bool, error) {
+	b, err := ioutil.ReadFile(p.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return "", "", false, nil
+		}
+		return "", "", false, errors.Wrapf(err, "failed to read %s", p.path)
+	}
+
+	var cfg dockerConfigFile
+	if err := json.Unmarshal(b, &cfg); err != nil {
+		return "", "", false, errors.Wrapf(err, "failed to parse %s", p.path)
+	}
+
+	host = resolveConfigHost(host)
+
+	if helper, ok := cfg.CredHelpers[host]; ok {
+		return NewNativeStoreProvider(helper).Get(ctx, host)
+	}
+	if cfg.CredsStore != "" {
+		return NewNativeStoreProvider(cfg.CredsStore).Get(ctx, host)
+	}
+
+	entry, ok := cfg.Auths[host]
+	if !ok || entry.Auth == "" {
+		return "", "", false, nil
+	}
+
+	decoded, err := base64.StdEncoding.DecodeString(entry.Auth)
+	if err != nil {
+		return "", "", false, errors.Wrapf(err, "failed to decode auth for %s", host)
+	}
+
+	parts := strings.SplitN(string(decoded), ":", 2)
+	if len(parts) != 2 {
+		return "", "", false, errors.Errorf("invalid auth entry for %s", host)
+	}
+	user, secret := parts[0], parts[1]
+
+	if user == identityToken {
+		return "", secret, true, nil
+	}
+
+	return user, secret, false, nil
+}
+
+// GenerateTokenOptionsWithProvider is GenerateTokenOptions, resolving the
+// username and secret to use from provider rather than from fixed
+// credentials. When provider returns an identity (refresh) token, the
+// resulting TokenOptions is set up so FetchTokenWithOAuth drives the
+// `grant_type=refresh_token` flow instead of a password grant.
+func GenerateTokenOptionsWithProvider(ctx context.Context, host string, provider CredentialProvider, c Challenge) (TokenOptions, error) {
+	user, secret, isRefreshToken, err := provider.Get(ctx, host)
+	if err != nil {
+		return TokenOptions{}, errors.Wrapf(err, "failed to get credentials for %s", host)
+	}
+
+	if isRefreshToken {
+		user = ""
+	}
+
+	return GenerateTokenOptions(ctx, host, user, secret, c)
+}
+
+// defaultDockerConfigPath returns the default location of the Docker CLI
+// config.json, honoring $DOCKER_CONFIG as the CLI itself does.
+func defaultDockerConfigPath() string {
+	if dir := os.Getenv("DOCKER_CONFIG"); dir != "" {
+		return filepath.Join(dir, "config.json")
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(home, ".docker", "config.json")
+}
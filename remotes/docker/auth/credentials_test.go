@@ -0,0 +1,170 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package auth
+
+import (
+	"context"
+	"encoding/base64"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+// fakeCredentialHelper writes a docker-credential-<name> script to a
+// temp directory, prepends it to PATH, and returns the helper name to
+// pass to NewNativeStoreProvider. script is run verbatim via /bin/sh.
+func fakeCredentialHelper(t *testing.T, name, script string) string {
+	t.Helper()
+	if runtime.GOOS == "windows" {
+		t.Skip("fake helper script is a shell script")
+	}
+
+	dir, err := ioutil.TempDir("", "docker-credential-helper-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	path := filepath.Join(dir, "docker-credential-"+name)
+	if err := ioutil.WriteFile(path, []byte("#!/bin/sh\n"+script), 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	oldPath := os.Getenv("PATH")
+	os.Setenv("PATH", dir+string(os.PathListSeparator)+oldPath)
+	t.Cleanup(func() { os.Setenv("PATH", oldPath) })
+
+	return name
+}
+
+func writeConfig(t *testing.T, contents string) string {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "docker-config-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	path := filepath.Join(dir, "config.json")
+	if err := ioutil.WriteFile(path, []byte(contents), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestDockerConfigProviderAuths(t *testing.T) {
+	auth := base64.StdEncoding.EncodeToString([]byte("user:pass"))
+	path := writeConfig(t, `{"auths":{"registry.example.com":{"auth":"`+auth+`"}}}`)
+
+	user, secret, isRefreshToken, err := NewDockerConfigProvider(path).Get(context.Background(), "registry.example.com")
+	if err != nil {
+		t.Fatalf("Get failed: %v", err)
+	}
+	if user != "user" || secret != "pass" || isRefreshToken {
+		t.Fatalf("got user=%q secret=%q isRefreshToken=%v", user, secret, isRefreshToken)
+	}
+}
+
+func TestDockerConfigProviderIdentityToken(t *testing.T) {
+	auth := base64.StdEncoding.EncodeToString([]byte("<token>:refresh-me"))
+	path := writeConfig(t, `{"auths":{"registry.example.com":{"auth":"`+auth+`"}}}`)
+
+	user, secret, isRefreshToken, err := NewDockerConfigProvider(path).Get(context.Background(), "registry.example.com")
+	if err != nil {
+		t.Fatalf("Get failed: %v", err)
+	}
+	if user != "" || secret != "refresh-me" || !isRefreshToken {
+		t.Fatalf("got user=%q secret=%q isRefreshToken=%v", user, secret, isRefreshToken)
+	}
+}
+
+func TestDockerConfigProviderMissingHost(t *testing.T) {
+	path := writeConfig(t, `{"auths":{}}`)
+
+	user, secret, isRefreshToken, err := NewDockerConfigProvider(path).Get(context.Background(), "registry.example.com")
+	if err != nil {
+		t.Fatalf("Get failed: %v", err)
+	}
+	if user != "" || secret != "" || isRefreshToken {
+		t.Fatalf("expected empty credentials for unknown host, got user=%q secret=%q isRefreshToken=%v", user, secret, isRefreshToken)
+	}
+}
+
+func TestDockerConfigProviderMissingFile(t *testing.T) {
+	user, secret, isRefreshToken, err := NewDockerConfigProvider(filepath.Join(os.TempDir(), "does-not-exist-config.json")).Get(context.Background(), "registry.example.com")
+	if err != nil {
+		t.Fatalf("expected a missing config file to be treated as no credentials, got error: %v", err)
+	}
+	if user != "" || secret != "" || isRefreshToken {
+		t.Fatalf("expected empty credentials, got user=%q secret=%q isRefreshToken=%v", user, secret, isRefreshToken)
+	}
+}
+
+// TestDockerConfigProviderHubAlias verifies that credentials stored under
+// the canonical Docker Hub key are found regardless of which Hub hostname
+// alias is actually queried.
+func TestDockerConfigProviderHubAlias(t *testing.T) {
+	auth := base64.StdEncoding.EncodeToString([]byte("hubuser:hubpass"))
+	path := writeConfig(t, `{"auths":{"https://index.docker.io/v1/":{"auth":"`+auth+`"}}}`)
+
+	for _, host := range []string{"docker.io", "index.docker.io", "registry-1.docker.io"} {
+		user, secret, _, err := NewDockerConfigProvider(path).Get(context.Background(), host)
+		if err != nil {
+			t.Fatalf("Get(%q) failed: %v", host, err)
+		}
+		if user != "hubuser" || secret != "hubpass" {
+			t.Fatalf("Get(%q): got user=%q secret=%q, want hubuser/hubpass", host, user, secret)
+		}
+	}
+}
+
+func TestNativeStoreProviderNotFound(t *testing.T) {
+	// Real docker-credential-helpers (credentials.Serve) write the
+	// not-found sentinel to stdout, not stderr; exercise that, not the
+	// more convenient-to-fake stderr stream.
+	helper := fakeCredentialHelper(t, "test-missing", `echo "credentials not found in native keychain"; exit 1`)
+
+	user, secret, isRefreshToken, err := NewNativeStoreProvider(helper).Get(context.Background(), "registry.example.com")
+	if err != nil {
+		t.Fatalf("expected a keychain cache miss to be treated as no credentials, got error: %v", err)
+	}
+	if user != "" || secret != "" || isRefreshToken {
+		t.Fatalf("expected empty credentials, got user=%q secret=%q isRefreshToken=%v", user, secret, isRefreshToken)
+	}
+}
+
+func TestNativeStoreProviderOtherError(t *testing.T) {
+	helper := fakeCredentialHelper(t, "test-broken", `echo "keychain is locked" 1>&2; exit 1`)
+
+	_, _, _, err := NewNativeStoreProvider(helper).Get(context.Background(), "registry.example.com")
+	if err == nil {
+		t.Fatal("expected a non-sentinel helper failure to be returned as an error")
+	}
+}
+
+func TestResolveConfigHost(t *testing.T) {
+	for _, host := range []string{"docker.io", "index.docker.io", "registry-1.docker.io"} {
+		if got := resolveConfigHost(host); got != dockerHubConfigKey {
+			t.Fatalf("resolveConfigHost(%q) = %q, want %q", host, got, dockerHubConfigKey)
+		}
+	}
+	if got := resolveConfigHost("registry.example.com"); got != "registry.example.com" {
+		t.Fatalf("resolveConfigHost should leave non-Hub hosts unchanged, got %q", got)
+	}
+}
@@ -102,7 +102,37 @@ type postTokenResponse struct {
 	Scope        string    `json:"scope"`
 }
 
+// OAuthTokenResponse is the full response to an OAuth2 token request, as
+// defined by the token authentication spec. Unlike the plain access token
+// returned by FetchToken and FetchTokenWithOAuth, it preserves the
+// refresh token and expiry metadata a server may have included so that
+// callers can cache the token and refresh it without a full
+// challenge/credential round trip.
+type OAuthTokenResponse struct {
+	AccessToken  string
+	RefreshToken string
+	ExpiresIn    int
+	IssuedAt     time.Time
+	Scope        string
+}
+
+// FetchTokenWithOAuth fetches a token using a POST request to the realm,
+// using the OAuth2 grant types described by the token authentication spec.
+//
+// Deprecated: Use FetchTokenWithOAuthResponse.
 func FetchTokenWithOAuth(ctx context.Context, client *http.Client, headers http.Header, clientID string, to TokenOptions) (string, error) {
+	resp, err := FetchTokenWithOAuthResponse(ctx, client, headers, clientID, to)
+	if err != nil {
+		return "", err
+	}
+	return resp.AccessToken, nil
+}
+
+// FetchTokenWithOAuthResponse fetches a token using a POST request to the
+// realm, using the OAuth2 grant types described by the token
+// authentication spec, and returns the full token response including any
+// refresh token and expiry metadata the server provided.
+func FetchTokenWithOAuthResponse(ctx context.Context, client *http.Client, headers http.Header, clientID string, to TokenOptions) (*OAuthTokenResponse, error) {
 	form := url.Values{}
 	if len(to.Scopes) > 0 {
 		form.Set("scope", strings.Join(to.Scopes, " "))
@@ -121,7 +151,7 @@ func FetchTokenWithOAuth(ctx context.Context, client *http.Client, headers http.
 
 	req, err := http.NewRequest("POST", to.Realm, strings.NewReader(form.Encode()))
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 	req.Header.Set("Content-Type", "application/x-www-form-urlencoded; charset=utf-8")
 	if headers != nil {
@@ -132,22 +162,28 @@ func FetchTokenWithOAuth(ctx context.Context, client *http.Client, headers http.
 
 	resp, err := ctxhttp.Do(ctx, client, req)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode < 200 || resp.StatusCode >= 400 {
-		return "", errors.WithStack(newUnexpectedStatusErr(resp))
+		return nil, errors.WithStack(newUnexpectedStatusErr(resp))
 	}
 
 	decoder := json.NewDecoder(resp.Body)
 
 	var tr postTokenResponse
 	if err = decoder.Decode(&tr); err != nil {
-		return "", errors.Errorf("unable to decode token response: %s", err)
+		return nil, errors.Errorf("unable to decode token response: %s", err)
 	}
 
-	return tr.AccessToken, nil
+	return &OAuthTokenResponse{
+		AccessToken:  tr.AccessToken,
+		RefreshToken: tr.RefreshToken,
+		ExpiresIn:    tr.ExpiresIn,
+		IssuedAt:     tr.IssuedAt,
+		Scope:        tr.Scope,
+	}, nil
 }
 
 type getTokenResponse struct {
@@ -159,11 +195,24 @@ type getTokenResponse struct {
 }
 
 // FetchToken fetches a token using a GET request
+//
+// Deprecated: Use FetchTokenResponse.
 func FetchToken(ctx context.Context, client *http.Client, headers http.Header, to TokenOptions) (string, error) {
-	req, err := http.NewRequest("GET", to.Realm, nil)
+	resp, err := FetchTokenResponse(ctx, client, headers, to)
 	if err != nil {
 		return "", err
 	}
+	return resp.AccessToken, nil
+}
+
+// FetchTokenResponse fetches a token using a GET request and returns the
+// full token response, including any refresh token and expiry metadata
+// the server provided.
+func FetchTokenResponse(ctx context.Context, client *http.Client, headers http.Header, to TokenOptions) (*OAuthTokenResponse, error) {
+	req, err := http.NewRequest("GET", to.Realm, nil)
+	if err != nil {
+		return nil, err
+	}
 
 	if headers != nil {
 		for k, v := range headers {
@@ -189,19 +238,19 @@ func FetchToken(ctx context.Context, client *http.Client, headers http.Header, t
 
 	resp, err := ctxhttp.Do(ctx, client, req)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode < 200 || resp.StatusCode >= 400 {
-		return "", errors.WithStack(newUnexpectedStatusErr(resp))
+		return nil, errors.WithStack(newUnexpectedStatusErr(resp))
 	}
 
 	decoder := json.NewDecoder(resp.Body)
 
 	var tr getTokenResponse
 	if err = decoder.Decode(&tr); err != nil {
-		return "", errors.Errorf("unable to decode token response: %s", err)
+		return nil, errors.Errorf("unable to decode token response: %s", err)
 	}
 
 	// `access_token` is equivalent to `token` and if both are specified
@@ -212,8 +261,13 @@ func FetchToken(ctx context.Context, client *http.Client, headers http.Header, t
 	}
 
 	if tr.Token == "" {
-		return "", ErrNoToken
+		return nil, ErrNoToken
 	}
 
-	return tr.Token, nil
+	return &OAuthTokenResponse{
+		AccessToken:  tr.Token,
+		RefreshToken: tr.RefreshToken,
+		ExpiresIn:    tr.ExpiresIn,
+		IssuedAt:     tr.IssuedAt,
+	}, nil
 }